@@ -0,0 +1,1127 @@
+// Copyright 2017 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package controller implements the Kubernetes controllers used by Citadel
+// to keep per-ServiceAccount workload secrets in sync with the cluster.
+package controller
+
+import (
+	"bytes"
+	"container/heap"
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	corev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	rbacv1client "k8s.io/client-go/kubernetes/typed/rbac/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"istio.io/istio/pkg/log"
+	k8ssecret "istio.io/istio/security/pkg/k8s/secret"
+	"istio.io/istio/security/pkg/pki/ca"
+	"istio.io/istio/security/pkg/pki/util"
+)
+
+const (
+	// IstioSecretType is the Kubernetes secret type for Istio workload certificates.
+	IstioSecretType v1.SecretType = "istio.io/key-and-cert"
+
+	// CertChainID is the ID/name for the certificate chain file.
+	CertChainID = "cert-chain.pem"
+	// PrivateKeyID is the ID/name for the private key file.
+	PrivateKeyID = "key.pem"
+	// RootCertID is the ID/name for the CA root certificate file.
+	RootCertID = "root-cert.pem"
+
+	// secretNamePrefix is prepended to a ServiceAccount's name to derive its secret name.
+	secretNamePrefix = "istio."
+
+	// secretResyncPeriod is how often the secret informer performs a full resync.
+	secretResyncPeriod = time.Minute
+
+	// secretCreationRetry is the total number of attempts made to create a secret
+	// before giving up.
+	secretCreationRetry = 3
+
+	// keySize is the RSA key size used for generated workload keys.
+	keySize = 2048
+
+	// NamespaceManagedLabel (ca.istio.io/env) lets a namespace opt in (or out) of
+	// management scoped to a particular Citadel storage namespace.
+	NamespaceManagedLabel = "ca.istio.io/env"
+	// NamespaceOverrideLabel (ca.istio.io/override) force-overrides the default
+	// management policy for a namespace, independent of NamespaceManagedLabel.
+	NamespaceOverrideLabel = "ca.istio.io/override"
+	// NamespaceParentLabel (ca.istio.io/parent) marks a namespace as a descendant
+	// of another namespace for the purposes of hierarchical configuration
+	// inheritance, HNC-style.
+	NamespaceParentLabel = "ca.istio.io/parent"
+	// NamespaceInheritedLabel is stamped onto secrets that were (re)issued because
+	// of configuration inherited from an ancestor namespace, so operators can
+	// audit where the effective configuration came from.
+	NamespaceInheritedLabel = "ca.istio.io/inherited-from"
+
+	// defaultSAReaderClusterRole is the ClusterRole bound to a ServiceAccount's
+	// bootstrapped RoleBinding when a RoleBindingTemplate does not specify one.
+	defaultSAReaderClusterRole = "istio-citadel-sa-reader"
+
+	rbacAPIGroup = "rbac.authorization.k8s.io"
+
+	// CertPolicyTTLAnnotation overrides certTTL for secrets issued for the
+	// annotated namespace or ServiceAccount.
+	CertPolicyTTLAnnotation = "ca.istio.io/ttl"
+	// CertPolicyGracePeriodRatioAnnotation overrides gracePeriodRatio for the
+	// annotated namespace or ServiceAccount.
+	CertPolicyGracePeriodRatioAnnotation = "ca.istio.io/grace-period-ratio"
+	// CertPolicyRSAKeySizeAnnotation overrides the RSA key size used for keys
+	// generated for the annotated namespace or ServiceAccount.
+	CertPolicyRSAKeySizeAnnotation = "ca.istio.io/rsa-key-size"
+	// CertPolicyExtraSANsAnnotation adds extra, comma-separated DNS SANs to
+	// certificates issued for the annotated namespace or ServiceAccount.
+	CertPolicyExtraSANsAnnotation = "ca.istio.io/extra-sans"
+)
+
+// DNSNameEntry describes the additional DNS SAN entries used for webhook
+// service accounts, e.g. the sidecar injector.
+type DNSNameEntry struct {
+	// ServiceName is the name of the K8s service that the DNS name maps to.
+	ServiceName string
+	// Namespace is the namespace that the service resides in.
+	Namespace string
+}
+
+// namespaceOverrides holds the effective cert-policy overrides for a single
+// secret issuance, merged from (in increasing precedence) an inherited
+// ancestor namespace, the SA's own namespace, and the SA itself. The ancestor
+// layer is only present for secrets issued by propagateToChildren; every
+// other issuance (saAdded, scrtUpdated, the renewal scheduler) merges only
+// the SA's own namespace and the SA.
+//
+// Webhook DNSNameEntry overrides and namespace/SA exclusions are deliberately
+// not modeled here: sc.webhooks is a single controller-wide map keyed by SA
+// name, with no per-namespace or per-ancestor form, so there is nothing
+// namespace-specific for a descendant to inherit. Only the cert-policy knobs
+// below (TTL, grace period, RSA key size, extra SANs), which do have a
+// per-namespace annotation form, propagate to descendants.
+type namespaceOverrides struct {
+	ttl              *time.Duration
+	gracePeriodRatio *float32
+	rsaKeySize       *int
+	extraSANs        []string
+
+	// inheritedFrom, when non-empty, is the ancestor namespace this override
+	// was propagated from, and is stamped onto issued secrets via
+	// NamespaceInheritedLabel so operators can audit inheritance.
+	inheritedFrom string
+}
+
+// computeCertPolicyOverrides parses the CertPolicy*Annotation annotations off
+// ns and sa into a namespaceOverrides, with sa's annotations taking
+// precedence over ns's. Either argument may be nil. Returns nil if neither
+// carries a recognized annotation with a valid value.
+func computeCertPolicyOverrides(ns *v1.Namespace, sa *v1.ServiceAccount) *namespaceOverrides {
+	overrides := &namespaceOverrides{}
+	if ns != nil {
+		applyCertPolicyAnnotations(overrides, ns.GetAnnotations(), "namespace "+ns.GetName())
+	}
+	if sa != nil {
+		applyCertPolicyAnnotations(overrides, sa.GetAnnotations(), "service account "+sa.GetNamespace()+"/"+sa.GetName())
+	}
+
+	if overrides.ttl == nil && overrides.gracePeriodRatio == nil && overrides.rsaKeySize == nil && overrides.extraSANs == nil {
+		return nil
+	}
+	return overrides
+}
+
+// applyCertPolicyAnnotations layers the CertPolicy*Annotation values found in
+// annotations onto overrides. source identifies the object they came from,
+// for logging only. An annotation present but holding an invalid value is
+// logged and left unset, falling back to the next most specific source; this
+// package has no EventRecorder wiring anywhere else, so a log line -- not a
+// Kubernetes Event -- is the intended, operator-visible fallback.
+func applyCertPolicyAnnotations(overrides *namespaceOverrides, annotations map[string]string, source string) {
+	if v, ok := annotations[CertPolicyTTLAnnotation]; ok {
+		if ttl, err := time.ParseDuration(v); err == nil {
+			overrides.ttl = &ttl
+		} else {
+			log.Warnf("invalid value %q for %s annotation on %s, ignoring: %v", v, CertPolicyTTLAnnotation, source, err)
+		}
+	}
+
+	if v, ok := annotations[CertPolicyGracePeriodRatioAnnotation]; ok {
+		if ratio, err := strconv.ParseFloat(v, 32); err == nil && ratio >= 0 && ratio <= 1 {
+			r := float32(ratio)
+			overrides.gracePeriodRatio = &r
+		} else {
+			log.Warnf("invalid value %q for %s annotation on %s, ignoring", v, CertPolicyGracePeriodRatioAnnotation, source)
+		}
+	}
+
+	if v, ok := annotations[CertPolicyRSAKeySizeAnnotation]; ok {
+		if size, err := strconv.Atoi(v); err == nil && size > 0 {
+			overrides.rsaKeySize = &size
+		} else {
+			log.Warnf("invalid value %q for %s annotation on %s, ignoring", v, CertPolicyRSAKeySizeAnnotation, source)
+		}
+	}
+
+	if v, ok := annotations[CertPolicyExtraSANsAnnotation]; ok && v != "" {
+		overrides.extraSANs = strings.Split(v, ",")
+	}
+}
+
+// RoleBindingTemplate describes a RoleBinding that should be created
+// alongside an Istio secret so that the owning ServiceAccount can read its
+// own credentials without external tooling having to grant that access.
+type RoleBindingTemplate struct {
+	// NameTemplate is a text/template string, executed against
+	// roleBindingTemplateData, that produces the RoleBinding's name.
+	NameTemplate string
+	// ClusterRoleName is the ClusterRole the ServiceAccount is bound to.
+	// Defaults to defaultSAReaderClusterRole if empty.
+	ClusterRoleName string
+}
+
+// roleBindingTemplateData is the data RoleBindingTemplate.NameTemplate is
+// executed against.
+type roleBindingTemplateData struct {
+	ServiceAccountName string
+	Namespace          string
+}
+
+// TimeSource abstracts wall-clock access so that certificate rotation timing
+// can be driven deterministically in tests.
+type TimeSource interface {
+	// UTCNow returns the current time in UTC.
+	UTCNow() time.Time
+}
+
+type realTimeSource struct{}
+
+func (realTimeSource) UTCNow() time.Time {
+	return time.Now().UTC()
+}
+
+// NewTimeSource returns the production TimeSource, backed by the real wall clock.
+func NewTimeSource() TimeSource {
+	return realTimeSource{}
+}
+
+// renewalTask is a pending entry in the controller's renewal heap: the secret
+// identified by namespace/name should be re-issued at or after nextRenewal.
+type renewalTask struct {
+	namespace   string
+	name        string
+	nextRenewal time.Time
+	index       int
+}
+
+// renewalQueue is a min-heap of renewalTask ordered by nextRenewal, so the
+// scheduler goroutine only ever has to look at, and sleep until, the head.
+type renewalQueue []*renewalTask
+
+func (q renewalQueue) Len() int { return len(q) }
+
+func (q renewalQueue) Less(i, j int) bool { return q[i].nextRenewal.Before(q[j].nextRenewal) }
+
+func (q renewalQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *renewalQueue) Push(x interface{}) {
+	task := x.(*renewalTask)
+	task.index = len(*q)
+	*q = append(*q, task)
+}
+
+func (q *renewalQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	task.index = -1
+	*q = old[:n-1]
+	return task
+}
+
+// SecretController manages the lifecycle of Istio secrets tied to Kubernetes
+// ServiceAccounts.
+type SecretController struct {
+	ca                        ca.CertificateAuthority
+	certTTL                   time.Duration
+	gracePeriodRatio          float32
+	minGracePeriod            time.Duration
+	dualUse                   bool
+	forCA                     bool
+	pkcs8Key                  bool
+	core                      corev1.CoreV1Interface
+	rbac                      rbacv1client.RbacV1Interface
+	namespaces                []string
+	webhooks                  map[string]*DNSNameEntry
+	istioCaStorageNamespace   string
+	enableNamespacesByDefault bool
+	timeSource                TimeSource
+	bootstrapRBAC             bool
+	roleBindingTemplates      []RoleBindingTemplate
+
+	scrtStore      cache.Store
+	scrtController cache.Controller
+
+	saStore      cache.Store
+	saController cache.Controller
+
+	nsStore      cache.Store
+	nsController cache.Controller
+
+	// hierarchyMu guards childrenByParent/parentByChild below.
+	hierarchyMu sync.RWMutex
+	// childrenByParent indexes, for every namespace that has descendants via
+	// NamespaceParentLabel, the set of its direct children.
+	childrenByParent map[string]map[string]bool
+	// parentByChild is the reverse index, used to detect cycles when a
+	// namespace's parent label changes.
+	parentByChild map[string]string
+
+	// renewalMu guards renewalQueue/renewalTasks below.
+	renewalMu sync.Mutex
+	// renewalQueue is a min-heap of pending renewals, keyed off each secret's
+	// NotAfter, gracePeriodRatio and minGracePeriod, so the renewal scheduler
+	// goroutine never has to scan the whole secret store.
+	renewalQueue renewalQueue
+	// renewalTasks indexes renewalQueue entries by "namespace/name" so they
+	// can be updated or removed in place as secrets change.
+	renewalTasks map[string]*renewalTask
+	// renewalWakeCh is signaled whenever renewalQueue's head may have changed,
+	// so the scheduler goroutine can re-evaluate how long to sleep.
+	renewalWakeCh chan struct{}
+}
+
+// NewSecretController returns a new SecretController. timeSource is normally
+// NewTimeSource() in production; tests can inject a FakeTimeSource to make
+// rotation timing deterministic. bootstrapRBAC, when true, makes the
+// controller create a RoleBinding from roleBindingTemplates (or a single
+// default template binding to defaultSAReaderClusterRole if none are given)
+// alongside every Istio secret it issues.
+func NewSecretController(ca ca.CertificateAuthority, enableNamespacesByDefault bool, certTTL time.Duration,
+	gracePeriodRatio float32, minGracePeriod time.Duration, dualUse bool,
+	core corev1.CoreV1Interface, forCA bool, pkcs8Key bool,
+	namespaces []string, webhooks map[string]*DNSNameEntry, istioCaStorageNamespace string,
+	timeSource TimeSource, rbac rbacv1client.RbacV1Interface, bootstrapRBAC bool,
+	roleBindingTemplates []RoleBindingTemplate) (*SecretController, error) {
+
+	if gracePeriodRatio < 0 || gracePeriodRatio > 1 {
+		return nil, fmt.Errorf("grace period ratio %f should be within [0, 1]", gracePeriodRatio)
+	}
+
+	if bootstrapRBAC && len(roleBindingTemplates) == 0 {
+		roleBindingTemplates = []RoleBindingTemplate{
+			{NameTemplate: "istio-citadel-sa-reader-{{.ServiceAccountName}}", ClusterRoleName: defaultSAReaderClusterRole},
+		}
+	}
+
+	c := &SecretController{
+		ca:                        ca,
+		enableNamespacesByDefault: enableNamespacesByDefault,
+		certTTL:                   certTTL,
+		gracePeriodRatio:          gracePeriodRatio,
+		minGracePeriod:            minGracePeriod,
+		dualUse:                   dualUse,
+		core:                      core,
+		rbac:                      rbac,
+		forCA:                     forCA,
+		pkcs8Key:                  pkcs8Key,
+		namespaces:                namespaces,
+		webhooks:                  webhooks,
+		istioCaStorageNamespace:   istioCaStorageNamespace,
+		timeSource:                timeSource,
+		bootstrapRBAC:             bootstrapRBAC,
+		roleBindingTemplates:      roleBindingTemplates,
+		childrenByParent:          make(map[string]map[string]bool),
+		parentByChild:             make(map[string]string),
+		renewalTasks:              make(map[string]*renewalTask),
+		renewalWakeCh:             make(chan struct{}, 1),
+	}
+
+	saLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return core.ServiceAccounts(metav1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return core.ServiceAccounts(metav1.NamespaceAll).Watch(options)
+		},
+	}
+	c.saStore, c.saController = cache.NewInformer(saLW, &v1.ServiceAccount{}, time.Minute, cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.saAdded,
+		DeleteFunc: c.saDeleted,
+	})
+
+	istioSecretSelector := fields.SelectorFromSet(map[string]string{"type": string(IstioSecretType)}).String()
+	scrtLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.FieldSelector = istioSecretSelector
+			return core.Secrets(metav1.NamespaceAll).List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.FieldSelector = istioSecretSelector
+			return core.Secrets(metav1.NamespaceAll).Watch(options)
+		},
+	}
+	c.scrtStore, c.scrtController = cache.NewInformer(scrtLW, &v1.Secret{}, secretResyncPeriod, cache.ResourceEventHandlerFuncs{
+		AddFunc:    c.scrtAdded,
+		UpdateFunc: c.scrtUpdated,
+		DeleteFunc: c.scrtDeleted,
+	})
+
+	nsLW := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return core.Namespaces().List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return core.Namespaces().Watch(options)
+		},
+	}
+	c.nsStore, c.nsController = cache.NewInformer(nsLW, &v1.Namespace{}, time.Minute, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if ns, ok := obj.(*v1.Namespace); ok {
+				c.recordNamespaceParent(ns)
+			}
+		},
+		UpdateFunc: c.namespaceUpdated,
+	})
+
+	return c, nil
+}
+
+// Run starts the underlying informers and the proactive renewal scheduler,
+// and blocks until stopCh is closed.
+func (sc *SecretController) Run(stopCh chan struct{}) {
+	go sc.saController.Run(stopCh)
+	go sc.scrtController.Run(stopCh)
+	go sc.nsController.Run(stopCh)
+	go sc.runRenewalLoop(stopCh)
+}
+
+// GetSecretName returns the name of the Istio secret for the given ServiceAccount name.
+func GetSecretName(saName string) string {
+	return secretNamePrefix + saName
+}
+
+func saNameFromSecretName(secretName string) string {
+	return strings.TrimPrefix(secretName, secretNamePrefix)
+}
+
+func (sc *SecretController) saAdded(obj interface{}) {
+	sa, ok := obj.(*v1.ServiceAccount)
+	if !ok {
+		log.Errorf("failed to convert object %v to service account", obj)
+		return
+	}
+	sc.ensureSecretForServiceAccount(sa)
+}
+
+func (sc *SecretController) saDeleted(obj interface{}) {
+	sa, ok := obj.(*v1.ServiceAccount)
+	if !ok {
+		log.Errorf("failed to convert object %v to service account", obj)
+		return
+	}
+	secretName := GetSecretName(sa.GetName())
+	if err := sc.core.Secrets(sa.GetNamespace()).Delete(secretName, &metav1.DeleteOptions{}); err != nil {
+		log.Errorf("failed to delete secret %s/%s: %v", sa.GetNamespace(), secretName, err)
+	}
+	sc.deleteRoleBindings(sa.GetName(), sa.GetNamespace())
+}
+
+func (sc *SecretController) scrtAdded(obj interface{}) {
+	scrt, ok := obj.(*v1.Secret)
+	if !ok {
+		log.Errorf("failed to convert object %v to secret", obj)
+		return
+	}
+	ns := sc.namespaceOrNil(scrt.GetNamespace())
+	sc.scheduleRenewal(scrt, sc.certPolicyOverridesFor(ns, scrt.GetNamespace(), scrt.GetName()))
+}
+
+func (sc *SecretController) scrtDeleted(obj interface{}) {
+	scrt, ok := obj.(*v1.Secret)
+	if !ok {
+		log.Errorf("failed to convert object %v to secret", obj)
+		return
+	}
+	sc.unscheduleRenewal(scrt.GetNamespace(), scrt.GetName())
+
+	saName := saNameFromSecretName(scrt.GetName())
+	sa, err := sc.core.ServiceAccounts(scrt.GetNamespace()).Get(saName, metav1.GetOptions{})
+	if err != nil {
+		log.Debugf("service account %s/%s no longer exists, not recreating its deleted secret: %v", scrt.GetNamespace(), saName, err)
+		sc.deleteRoleBindings(saName, scrt.GetNamespace())
+		return
+	}
+
+	log.Infof("re-creating deleted secret for existing service account %s/%s", scrt.GetNamespace(), saName)
+	sc.ensureSecretForServiceAccount(sa)
+}
+
+func (sc *SecretController) scrtUpdated(oldObj, newObj interface{}) {
+	scrt, ok := newObj.(*v1.Secret)
+	if !ok {
+		log.Errorf("failed to convert object %v to secret", newObj)
+		return
+	}
+
+	namespace := scrt.GetNamespace()
+	name := scrt.GetName()
+
+	// Overrides must be resolved before scheduling: secretResyncPeriod
+	// delivers an Update for every secret, and scheduleRenewal unconditionally
+	// overwrites the heap entry's nextRenewal, so passing nil here would
+	// clobber a narrower override back to the controller-wide default on
+	// every resync.
+	ns := sc.namespaceOrNil(namespace)
+	overrides := sc.certPolicyOverridesFor(ns, namespace, name)
+	sc.scheduleRenewal(scrt, overrides)
+
+	rootCertChanged := !bytes.Equal(scrt.Data[RootCertID], sc.ca.GetCAKeyCertBundle().GetRootCertPem())
+
+	needsRenewal := true
+	if cert, err := util.ParsePemEncodedCertificate(scrt.Data[CertChainID]); err == nil {
+		needsRenewal = sc.certIsExpiringSoon(cert, overrides)
+	}
+
+	if !needsRenewal && !rootCertChanged {
+		return
+	}
+
+	if !sc.namespaceIsManaged(ns) {
+		return
+	}
+
+	if err := sc.reissueSecret(saNameFromSecretName(name), namespace, name, ns, overrides); err != nil {
+		log.Errorf("failed to update secret %s/%s: %v", namespace, name, err)
+	}
+}
+
+// certPolicyOverridesFor resolves the cert-policy overrides in effect for the
+// secret identified by namespace/name, given its already-fetched namespace
+// (which may be nil), by additionally looking up its owning ServiceAccount.
+// ServiceAccount lookup failure is tolerated, falling back to whatever the
+// namespace alone provides.
+func (sc *SecretController) certPolicyOverridesFor(ns *v1.Namespace, namespace, name string) *namespaceOverrides {
+	saName := saNameFromSecretName(name)
+	sa, err := sc.core.ServiceAccounts(namespace).Get(saName, metav1.GetOptions{})
+	if err != nil {
+		log.Debugf("service account %s/%s not found while resolving cert policy overrides: %v", namespace, saName, err)
+		sa = nil
+	}
+	return computeCertPolicyOverrides(ns, sa)
+}
+
+// gracePeriodFor returns the effective grace period for a certificate with
+// the given validity window, honoring overrides.gracePeriodRatio in place of
+// sc.gracePeriodRatio when set, and sc.minGracePeriod as a floor in all cases.
+func (sc *SecretController) gracePeriodFor(notBefore, notAfter time.Time, overrides *namespaceOverrides) time.Duration {
+	ratio := sc.gracePeriodRatio
+	if overrides != nil && overrides.gracePeriodRatio != nil {
+		ratio = *overrides.gracePeriodRatio
+	}
+	gracePeriod := time.Duration(ratio * float32(notAfter.Sub(notBefore)))
+	if gracePeriod < sc.minGracePeriod {
+		gracePeriod = sc.minGracePeriod
+	}
+	return gracePeriod
+}
+
+func (sc *SecretController) certIsExpiringSoon(cert *x509.Certificate, overrides *namespaceOverrides) bool {
+	gracePeriod := sc.gracePeriodFor(cert.NotBefore, cert.NotAfter, overrides)
+	return !sc.timeSource.UTCNow().Before(cert.NotAfter.Add(-gracePeriod))
+}
+
+// scheduleRenewal (re)computes the next renewal instant for scrt from its
+// certificate and (re)inserts it into the renewal heap, so the scheduler
+// goroutine can re-issue it proactively instead of waiting for the next
+// informer resync to scan the whole store.
+func (sc *SecretController) scheduleRenewal(scrt *v1.Secret, overrides *namespaceOverrides) {
+	cert, err := util.ParsePemEncodedCertificate(scrt.Data[CertChainID])
+	if err != nil {
+		// An unparsable certificate is handled reactively by scrtUpdated, which
+		// reissues it, instead of being scheduled, since we have no NotAfter to
+		// schedule against.
+		return
+	}
+	nextRenewal := cert.NotAfter.Add(-sc.gracePeriodFor(cert.NotBefore, cert.NotAfter, overrides))
+	key := scrt.GetNamespace() + "/" + scrt.GetName()
+
+	sc.renewalMu.Lock()
+	defer sc.renewalMu.Unlock()
+
+	if task, exists := sc.renewalTasks[key]; exists {
+		task.nextRenewal = nextRenewal
+		heap.Fix(&sc.renewalQueue, task.index)
+	} else {
+		task := &renewalTask{namespace: scrt.GetNamespace(), name: scrt.GetName(), nextRenewal: nextRenewal}
+		sc.renewalTasks[key] = task
+		heap.Push(&sc.renewalQueue, task)
+	}
+	sc.wakeSchedulerLocked()
+}
+
+// unscheduleRenewal removes any pending renewal heap entry for namespace/name.
+func (sc *SecretController) unscheduleRenewal(namespace, name string) {
+	key := namespace + "/" + name
+
+	sc.renewalMu.Lock()
+	defer sc.renewalMu.Unlock()
+
+	task, exists := sc.renewalTasks[key]
+	if !exists {
+		return
+	}
+	heap.Remove(&sc.renewalQueue, task.index)
+	delete(sc.renewalTasks, key)
+}
+
+// wakeSchedulerLocked signals the renewal scheduler goroutine that the heap
+// head may have changed. Callers must hold sc.renewalMu.
+func (sc *SecretController) wakeSchedulerLocked() {
+	select {
+	case sc.renewalWakeCh <- struct{}{}:
+	default:
+	}
+}
+
+// runRenewalLoop is the single goroutine that sleeps until the renewal
+// heap's head fires, re-issues that secret, and repeats.
+func (sc *SecretController) runRenewalLoop(stopCh <-chan struct{}) {
+	for {
+		wait := sc.nextRenewalWait()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-stopCh:
+			timer.Stop()
+			return
+		case <-sc.renewalWakeCh:
+			timer.Stop()
+			continue
+		case <-timer.C:
+		}
+
+		sc.renewDueSecrets()
+	}
+}
+
+// nextRenewalWait returns how long the scheduler goroutine should sleep
+// before the heap head is due for renewal.
+func (sc *SecretController) nextRenewalWait() time.Duration {
+	sc.renewalMu.Lock()
+	defer sc.renewalMu.Unlock()
+
+	if len(sc.renewalQueue) == 0 {
+		return time.Hour
+	}
+	wait := sc.renewalQueue[0].nextRenewal.Sub(sc.timeSource.UTCNow())
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// renewDueSecrets pops and re-issues every heap entry whose nextRenewal has
+// already passed.
+func (sc *SecretController) renewDueSecrets() {
+	for {
+		task := sc.popDueRenewal()
+		if task == nil {
+			return
+		}
+		sc.renewSecretNow(task.namespace, task.name)
+	}
+}
+
+func (sc *SecretController) popDueRenewal() *renewalTask {
+	sc.renewalMu.Lock()
+	defer sc.renewalMu.Unlock()
+
+	if len(sc.renewalQueue) == 0 || sc.renewalQueue[0].nextRenewal.After(sc.timeSource.UTCNow()) {
+		return nil
+	}
+	task := heap.Pop(&sc.renewalQueue).(*renewalTask)
+	delete(sc.renewalTasks, task.namespace+"/"+task.name)
+	return task
+}
+
+// renewSecretNow re-issues the secret identified by namespace/name, if its
+// namespace is still managed.
+func (sc *SecretController) renewSecretNow(namespace, name string) {
+	ns := sc.namespaceOrNil(namespace)
+	if !sc.namespaceIsManaged(ns) {
+		return
+	}
+
+	saName := saNameFromSecretName(name)
+	if err := sc.reissueSecret(saName, namespace, name, ns, sc.certPolicyOverridesFor(ns, namespace, name)); err != nil {
+		log.Errorf("failed to proactively renew secret %s/%s: %v", namespace, name, err)
+	}
+}
+
+// namespaceOrNil fetches the named namespace, tolerating a lookup error by
+// logging and returning nil instead of failing the caller outright. ns
+// accessors used downstream (namespaceIsManaged, computeCertPolicyOverrides)
+// are nil-safe and fall back to the controller-wide defaults in that case.
+func (sc *SecretController) namespaceOrNil(name string) *v1.Namespace {
+	ns, err := sc.core.Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		log.Debugf("failed to get namespace %s, falling back to defaults: %v", name, err)
+		return nil
+	}
+	return ns
+}
+
+// namespaceIsManaged reports whether secrets should be managed for the given
+// namespace, honoring NamespaceOverrideLabel first, then NamespaceManagedLabel,
+// falling back to the controller-wide default. ns may be nil, e.g. when its
+// lookup failed, in which case the controller-wide default applies.
+func (sc *SecretController) namespaceIsManaged(ns *v1.Namespace) bool {
+	if ns == nil {
+		return sc.enableNamespacesByDefault
+	}
+
+	if override, ok := ns.GetLabels()[NamespaceOverrideLabel]; ok {
+		if v, err := strconv.ParseBool(override); err == nil {
+			return v
+		}
+		log.Warnf("invalid value %q for %s label on namespace %s, ignoring", override, NamespaceOverrideLabel, ns.GetName())
+	}
+
+	if managedFor, ok := ns.GetLabels()[NamespaceManagedLabel]; ok {
+		return managedFor == sc.istioCaStorageNamespace
+	}
+
+	return sc.enableNamespacesByDefault
+}
+
+// namespaceUpdated handles both retroactive activation of newly-managed
+// namespaces and propagation of inherited configuration to descendant
+// namespaces when a parent namespace's configuration changes.
+func (sc *SecretController) namespaceUpdated(oldObj, newObj interface{}) {
+	oldNs, ok := oldObj.(*v1.Namespace)
+	if !ok {
+		log.Errorf("failed to convert old object %v to namespace", oldObj)
+		return
+	}
+	newNs, ok := newObj.(*v1.Namespace)
+	if !ok {
+		log.Errorf("failed to convert new object %v to namespace", newObj)
+		return
+	}
+
+	sc.recordNamespaceParent(newNs)
+
+	wasManaged := sc.namespaceIsManaged(oldNs)
+	isManaged := sc.namespaceIsManaged(newNs)
+	if !wasManaged && isManaged {
+		sc.activateNamespace(newNs)
+		// A newly-managed namespace must push its current config down to any
+		// already-managed descendants (e.g. to create a secret for a child
+		// service account that was waiting on it), regardless of whether its
+		// cert-policy annotations happen to match what they were while it was
+		// unmanaged.
+		sc.propagateToChildren(newNs)
+	} else if sc.namespaceConfigChanged(oldNs, newNs) {
+		if !overridesEqual(computeCertPolicyOverrides(oldNs, nil), computeCertPolicyOverrides(newNs, nil)) {
+			sc.propagateToChildren(newNs)
+		}
+	}
+}
+
+// activateNamespace (re)issues secrets for every ServiceAccount that already
+// exists in a namespace that has just become managed.
+func (sc *SecretController) activateNamespace(ns *v1.Namespace) {
+	log.Infof("namespace %s became managed, generating secrets for its existing service accounts", ns.GetName())
+	sas, err := sc.core.ServiceAccounts(ns.GetName()).List(metav1.ListOptions{})
+	if err != nil {
+		log.Errorf("failed to list service accounts in namespace %s: %v", ns.GetName(), err)
+		return
+	}
+	for i := range sas.Items {
+		sa := &sas.Items[i]
+		sc.upsertSecret(sa, ns, computeCertPolicyOverrides(ns, sa))
+	}
+}
+
+// certPolicyRelevantAnnotations are the annotation keys that affect what
+// propagateToChildren pushes down to descendants; a namespace update that
+// touches none of them (and doesn't move ns itself in the hierarchy) has
+// nothing for descendants to inherit.
+var certPolicyRelevantAnnotations = []string{
+	CertPolicyTTLAnnotation,
+	CertPolicyGracePeriodRatioAnnotation,
+	CertPolicyRSAKeySizeAnnotation,
+	CertPolicyExtraSANsAnnotation,
+}
+
+// namespaceConfigChanged reports whether a namespace update changed anything
+// that descendant namespaces might inherit: one of its cert-policy
+// annotations, or its own parent in the hierarchy. Unrelated label/annotation
+// churn (e.g. an operator tagging the namespace) must not force every
+// descendant secret to be reissued with a brand-new key.
+func (sc *SecretController) namespaceConfigChanged(oldNs, newNs *v1.Namespace) bool {
+	if oldNs.GetLabels()[NamespaceParentLabel] != newNs.GetLabels()[NamespaceParentLabel] {
+		return true
+	}
+	oldAnnotations, newAnnotations := oldNs.GetAnnotations(), newNs.GetAnnotations()
+	for _, key := range certPolicyRelevantAnnotations {
+		if oldAnnotations[key] != newAnnotations[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// overridesEqual reports whether a and b represent the same effective
+// cert-policy overrides, so namespaceUpdated can skip propagating to
+// descendants whose inherited config wouldn't actually change.
+func overridesEqual(a, b *namespaceOverrides) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	switch {
+	case (a.ttl == nil) != (b.ttl == nil):
+		return false
+	case a.ttl != nil && *a.ttl != *b.ttl:
+		return false
+	case (a.gracePeriodRatio == nil) != (b.gracePeriodRatio == nil):
+		return false
+	case a.gracePeriodRatio != nil && *a.gracePeriodRatio != *b.gracePeriodRatio:
+		return false
+	case (a.rsaKeySize == nil) != (b.rsaKeySize == nil):
+		return false
+	case a.rsaKeySize != nil && *a.rsaKeySize != *b.rsaKeySize:
+		return false
+	}
+	if len(a.extraSANs) != len(b.extraSANs) {
+		return false
+	}
+	for i := range a.extraSANs {
+		if a.extraSANs[i] != b.extraSANs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// recordNamespaceParent updates the parent/child hierarchy index for ns,
+// refusing to record an edge that would introduce a cycle.
+func (sc *SecretController) recordNamespaceParent(ns *v1.Namespace) {
+	parent, ok := ns.GetLabels()[NamespaceParentLabel]
+	child := ns.GetName()
+
+	sc.hierarchyMu.Lock()
+	defer sc.hierarchyMu.Unlock()
+
+	if oldParent, had := sc.parentByChild[child]; had {
+		delete(sc.childrenByParent[oldParent], child)
+	}
+
+	if !ok || parent == "" {
+		delete(sc.parentByChild, child)
+		return
+	}
+
+	if sc.introducesCycleLocked(child, parent) {
+		log.Errorf("namespace %s declares parent %s which would introduce a cycle, ignoring", child, parent)
+		delete(sc.parentByChild, child)
+		return
+	}
+
+	sc.parentByChild[child] = parent
+	if sc.childrenByParent[parent] == nil {
+		sc.childrenByParent[parent] = make(map[string]bool)
+	}
+	sc.childrenByParent[parent][child] = true
+}
+
+// introducesCycleLocked reports whether setting child's parent to parent would
+// create a cycle in the hierarchy. Callers must hold sc.hierarchyMu.
+func (sc *SecretController) introducesCycleLocked(child, parent string) bool {
+	visited := map[string]bool{child: true}
+	cur := parent
+	for {
+		if visited[cur] {
+			return true
+		}
+		visited[cur] = true
+		next, ok := sc.parentByChild[cur]
+		if !ok {
+			return false
+		}
+		cur = next
+	}
+}
+
+// propagateToChildren re-issues secrets for every direct child of ns so that
+// they pick up ns's current cert-policy overrides (TTL, grace period, RSA
+// key size, extra SANs), then recurses into each child. A deeper descendant
+// is re-issued with the overrides of its own direct parent, not of ns.
+func (sc *SecretController) propagateToChildren(ns *v1.Namespace) {
+	sc.hierarchyMu.RLock()
+	children := make([]string, 0, len(sc.childrenByParent[ns.GetName()]))
+	for child := range sc.childrenByParent[ns.GetName()] {
+		children = append(children, child)
+	}
+	sc.hierarchyMu.RUnlock()
+
+	for _, child := range children {
+		childNs, err := sc.core.Namespaces().Get(child, metav1.GetOptions{})
+		if err != nil {
+			log.Errorf("failed to get descendant namespace %s of %s: %v", child, ns.GetName(), err)
+			continue
+		}
+		if sc.namespaceIsManaged(childNs) {
+			sas, err := sc.core.ServiceAccounts(child).List(metav1.ListOptions{})
+			if err != nil {
+				log.Errorf("failed to list service accounts in descendant namespace %s: %v", child, err)
+				continue
+			}
+			for i := range sas.Items {
+				sa := &sas.Items[i]
+				// ns's annotations are the base layer; the child namespace's and
+				// the ServiceAccount's own annotations take precedence over them.
+				overrides := &namespaceOverrides{inheritedFrom: ns.GetName()}
+				applyCertPolicyAnnotations(overrides, ns.GetAnnotations(), "namespace "+ns.GetName())
+				applyCertPolicyAnnotations(overrides, childNs.GetAnnotations(), "namespace "+child)
+				applyCertPolicyAnnotations(overrides, sa.GetAnnotations(), "service account "+child+"/"+sa.GetName())
+				secretName := GetSecretName(sa.GetName())
+				if err := sc.upsertOrReissueSecret(sa.GetName(), child, secretName, childNs, overrides); err != nil {
+					log.Errorf("failed to propagate inherited config to secret %s/%s: %v", child, secretName, err)
+				}
+			}
+		}
+		// A child may itself be a parent; propagate recursively.
+		sc.propagateToChildren(childNs)
+	}
+}
+
+// upsertSecret creates a secret for sa if one does not already exist in the
+// local store and ns is managed. ns must already have been fetched by the
+// caller. overrides, if non-nil, is the cert policy to issue with; when its
+// inheritedFrom is set, that namespace is stamped onto the created secret via
+// NamespaceInheritedLabel.
+func (sc *SecretController) upsertSecret(sa *v1.ServiceAccount, ns *v1.Namespace, overrides *namespaceOverrides) {
+	if !sc.namespaceIsManaged(ns) {
+		return
+	}
+
+	secretName := GetSecretName(sa.GetName())
+	if _, exists, _ := sc.scrtStore.GetByKey(sa.GetNamespace() + "/" + secretName); exists {
+		return
+	}
+
+	if err := sc.createSecret(sa.GetName(), sa.GetNamespace(), secretName, overrides); err != nil {
+		log.Errorf("failed to create secret %s/%s: %v", sa.GetNamespace(), secretName, err)
+	}
+}
+
+// ensureSecretForServiceAccount fetches sa's namespace and, if it is managed
+// and the secret does not already exist, creates it.
+func (sc *SecretController) ensureSecretForServiceAccount(sa *v1.ServiceAccount) {
+	ns := sc.namespaceOrNil(sa.GetNamespace())
+	sc.upsertSecret(sa, ns, computeCertPolicyOverrides(ns, sa))
+}
+
+func (sc *SecretController) createSecret(saName, saNamespace, secretName string, overrides *namespaceOverrides) error {
+	chain, key, err := sc.generateKeyAndCert(saName, saNamespace, overrides)
+	if err != nil {
+		return err
+	}
+
+	secret := k8ssecret.BuildSecret(saName, secretName, saNamespace, chain, key, sc.ca.GetCAKeyCertBundle().GetRootCertPem(), nil, nil, IstioSecretType)
+	if overrides != nil && overrides.inheritedFrom != "" {
+		if secret.Labels == nil {
+			secret.Labels = make(map[string]string)
+		}
+		secret.Labels[NamespaceInheritedLabel] = overrides.inheritedFrom
+	}
+
+	var createErr error
+	for attempt := 0; attempt < secretCreationRetry; attempt++ {
+		if _, createErr = sc.core.Secrets(saNamespace).Create(secret); createErr == nil {
+			sc.createRoleBindings(saName, saNamespace)
+			return nil
+		}
+		log.Warnf("failed to create secret %s/%s (attempt %d/%d): %v", saNamespace, secretName, attempt+1, secretCreationRetry, createErr)
+	}
+	return createErr
+}
+
+// createRoleBindings creates, for each configured RoleBindingTemplate, a
+// RoleBinding granting saName read access to its own Istio secret. A no-op
+// unless bootstrapRBAC is enabled.
+func (sc *SecretController) createRoleBindings(saName, saNamespace string) {
+	if !sc.bootstrapRBAC {
+		return
+	}
+	for _, tmpl := range sc.roleBindingTemplates {
+		name, err := renderRoleBindingName(tmpl.NameTemplate, saName, saNamespace)
+		if err != nil {
+			log.Errorf("failed to render role binding name for %s/%s: %v", saNamespace, saName, err)
+			continue
+		}
+		clusterRole := tmpl.ClusterRoleName
+		if clusterRole == "" {
+			clusterRole = defaultSAReaderClusterRole
+		}
+		rb := &rbacv1.RoleBinding{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: saNamespace,
+			},
+			RoleRef: rbacv1.RoleRef{
+				APIGroup: rbacAPIGroup,
+				Kind:     "ClusterRole",
+				Name:     clusterRole,
+			},
+			Subjects: []rbacv1.Subject{
+				{
+					Kind:      "ServiceAccount",
+					Name:      saName,
+					Namespace: saNamespace,
+				},
+			},
+		}
+		if _, err := sc.rbac.RoleBindings(saNamespace).Create(rb); err != nil {
+			log.Errorf("failed to create role binding %s/%s: %v", saNamespace, name, err)
+		}
+	}
+}
+
+// deleteRoleBindings removes the RoleBindings created by createRoleBindings
+// for saName. A no-op unless bootstrapRBAC is enabled.
+func (sc *SecretController) deleteRoleBindings(saName, saNamespace string) {
+	if !sc.bootstrapRBAC {
+		return
+	}
+	for _, tmpl := range sc.roleBindingTemplates {
+		name, err := renderRoleBindingName(tmpl.NameTemplate, saName, saNamespace)
+		if err != nil {
+			log.Errorf("failed to render role binding name for %s/%s: %v", saNamespace, saName, err)
+			continue
+		}
+		if err := sc.rbac.RoleBindings(saNamespace).Delete(name, &metav1.DeleteOptions{}); err != nil {
+			log.Errorf("failed to delete role binding %s/%s: %v", saNamespace, name, err)
+		}
+	}
+}
+
+func renderRoleBindingName(nameTemplate, saName, saNamespace string) (string, error) {
+	tmpl, err := template.New("rolebinding-name").Parse(nameTemplate)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, roleBindingTemplateData{ServiceAccountName: saName, Namespace: saNamespace}); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// upsertOrReissueSecret creates a secret for saName in saNamespace if the
+// local store has no record of it yet, or reissues it otherwise. Used when
+// propagating inherited namespace configuration to descendants, where a
+// child ServiceAccount may not have an Istio secret yet (e.g. it became
+// managed concurrently with the ancestor's config change), so blindly
+// calling reissueSecret's Update would silently drop the inherited config.
+func (sc *SecretController) upsertOrReissueSecret(saName, saNamespace, secretName string, ns *v1.Namespace, overrides *namespaceOverrides) error {
+	if _, exists, _ := sc.scrtStore.GetByKey(saNamespace + "/" + secretName); !exists {
+		return sc.createSecret(saName, saNamespace, secretName, overrides)
+	}
+	return sc.reissueSecret(saName, saNamespace, secretName, ns, overrides)
+}
+
+// reissueSecret regenerates and updates an existing secret, e.g. because it is
+// expiring or because it must pick up an ancestor namespace's overrides.
+func (sc *SecretController) reissueSecret(saName, saNamespace, secretName string, ns *v1.Namespace, overrides *namespaceOverrides) error {
+	chain, key, err := sc.generateKeyAndCert(saName, saNamespace, overrides)
+	if err != nil {
+		return err
+	}
+
+	secret := k8ssecret.BuildSecret(saName, secretName, saNamespace, chain, key, sc.ca.GetCAKeyCertBundle().GetRootCertPem(), nil, nil, IstioSecretType)
+	if overrides != nil && overrides.inheritedFrom != "" {
+		if secret.Labels == nil {
+			secret.Labels = make(map[string]string)
+		}
+		secret.Labels[NamespaceInheritedLabel] = overrides.inheritedFrom
+	}
+
+	_, err = sc.core.Secrets(saNamespace).Update(secret)
+	return err
+}
+
+func (sc *SecretController) generateKeyAndCert(saName, saNamespace string, overrides *namespaceOverrides) (certChain, privateKey []byte, err error) {
+	webhooks := sc.webhooks
+	ttl := sc.certTTL
+	rsaKeySize := keySize
+	var extraSANs []string
+	if overrides != nil {
+		if overrides.ttl != nil {
+			ttl = *overrides.ttl
+		}
+		if overrides.rsaKeySize != nil {
+			rsaKeySize = *overrides.rsaKeySize
+		}
+		extraSANs = overrides.extraSANs
+	}
+
+	host := fmt.Sprintf("%s.%s.svc.cluster.local", saName, saNamespace)
+	if entry, ok := webhooks[saName]; ok {
+		host = fmt.Sprintf("%s,%s.%s.svc", host, entry.ServiceName, entry.Namespace)
+	}
+	for _, san := range extraSANs {
+		host = fmt.Sprintf("%s,%s", host, san)
+	}
+
+	options := util.CertOptions{
+		Host:       host,
+		RSAKeySize: rsaKeySize,
+		IsDualUse:  sc.dualUse,
+		PKCS8Key:   sc.pkcs8Key,
+	}
+
+	csrPEM, keyPEM, err := util.GenCSR(options)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM, err := sc.ca.Sign(csrPEM, ttl, sc.forCA)
+	if err != nil {
+		return nil, nil, err
+	}
+	certPEM = append(certPEM, sc.ca.GetCAKeyCertBundle().GetCertChainPem()...)
+
+	return certPEM, keyPEM, nil
+}
@@ -17,6 +17,8 @@ package controller
 import (
 	"bytes"
 	"fmt"
+	"reflect"
+	"sync"
 	"testing"
 	"time"
 
@@ -154,7 +156,7 @@ func TestSecretController(t *testing.T) {
 		}
 		controller, err := NewSecretController(createFakeCA(), enableNamespacesByDefault, defaultTTL,
 			tc.gracePeriodRatio, defaultMinGracePeriod, false, client.CoreV1(), false, false,
-			[]string{metav1.NamespaceAll}, webhooks, "test-ns")
+			[]string{metav1.NamespaceAll}, webhooks, "test-ns", NewTimeSource(), client.RbacV1(), false, nil)
 		if tc.shouldFail {
 			if err == nil {
 				t.Errorf("should have failed to create secret controller")
@@ -186,13 +188,72 @@ func TestSecretController(t *testing.T) {
 	}
 }
 
+func TestSecretControllerRBACBootstrap(t *testing.T) {
+	secretGvr := schema.GroupVersionResource{
+		Resource: "secrets",
+		Version:  "v1",
+	}
+	nsGvr := schema.GroupVersionResource{
+		Resource: "namespaces",
+		Version:  "v1",
+	}
+	rbGvr := schema.GroupVersionResource{
+		Group:    "rbac.authorization.k8s.io",
+		Resource: "rolebindings",
+		Version:  "v1",
+	}
+
+	testCases := map[string]struct {
+		saToAdd         *v1.ServiceAccount
+		saToDelete      *v1.ServiceAccount
+		expectedActions []ktesting.Action
+	}{
+		"adding a service account creates a secret and a role binding": {
+			saToAdd: createServiceAccount("test", "test-ns"),
+			expectedActions: []ktesting.Action{
+				ktesting.NewGetAction(nsGvr, "test-ns", "test-ns"),
+				ktesting.NewCreateAction(secretGvr, "test-ns", istioTestSecret),
+				ktesting.NewCreateAction(rbGvr, "test-ns", nil),
+			},
+		},
+		"removing a service account deletes its secret and role binding": {
+			saToDelete: createServiceAccount("deleted", "deleted-ns"),
+			expectedActions: []ktesting.Action{
+				ktesting.NewDeleteAction(secretGvr, "deleted-ns", "istio.deleted"),
+				ktesting.NewDeleteAction(rbGvr, "deleted-ns", "istio-citadel-sa-reader-deleted"),
+			},
+		},
+	}
+
+	for k, tc := range testCases {
+		client := fake.NewSimpleClientset()
+		controller, err := NewSecretController(createFakeCA(), enableNamespacesByDefault, defaultTTL,
+			defaultGracePeriodRatio, defaultMinGracePeriod, false, client.CoreV1(), false, false,
+			[]string{metav1.NamespaceAll}, nil, "test-ns", NewTimeSource(), client.RbacV1(), true, nil)
+		if err != nil {
+			t.Fatalf("failed to create secret controller: %v", err)
+		}
+
+		if tc.saToAdd != nil {
+			controller.saAdded(tc.saToAdd)
+		}
+		if tc.saToDelete != nil {
+			controller.saDeleted(tc.saToDelete)
+		}
+
+		if err := checkActions(client.Actions(), tc.expectedActions); err != nil {
+			t.Errorf("Case %q: %s", k, err.Error())
+		}
+	}
+}
+
 func TestSecretContent(t *testing.T) {
 	saName := "test-serviceaccount"
 	saNamespace := "test-namespace"
 	client := fake.NewSimpleClientset()
 	controller, err := NewSecretController(createFakeCA(), enableNamespacesByDefault, defaultTTL,
 		defaultGracePeriodRatio, defaultMinGracePeriod, false, client.CoreV1(), false, false,
-		[]string{metav1.NamespaceAll}, map[string]*DNSNameEntry{}, "test-namespace")
+		[]string{metav1.NamespaceAll}, map[string]*DNSNameEntry{}, "test-namespace", NewTimeSource(), client.RbacV1(), false, nil)
 	if err != nil {
 		t.Errorf("Failed to create secret controller: %v", err)
 	}
@@ -215,7 +276,7 @@ func TestDeletedIstioSecret(t *testing.T) {
 	client := fake.NewSimpleClientset()
 	controller, err := NewSecretController(createFakeCA(), enableNamespacesByDefault, defaultTTL,
 		defaultGracePeriodRatio, defaultMinGracePeriod, false, client.CoreV1(), false, false,
-		[]string{metav1.NamespaceAll}, nil, "test-ns")
+		[]string{metav1.NamespaceAll}, nil, "test-ns", NewTimeSource(), client.RbacV1(), false, nil)
 	if err != nil {
 		t.Errorf("failed to create secret controller: %v", err)
 	}
@@ -281,6 +342,10 @@ func TestUpdateSecret(t *testing.T) {
 		Resource: "namespaces",
 		Version:  "v1",
 	}
+	saSchema := schema.GroupVersionResource{
+		Resource: "serviceaccounts",
+		Version:  "v1",
+	}
 
 	testCases := map[string]struct {
 		expectedActions  []ktesting.Action
@@ -289,6 +354,8 @@ func TestUpdateSecret(t *testing.T) {
 		rootCert         []byte
 		gracePeriodRatio float32
 		certIsInvalid    bool
+		nsAnnotations    map[string]string
+		saAnnotations    map[string]string
 	}{
 		"Does not update non-expiring secret": {
 			expectedActions:  []ktesting.Action{},
@@ -299,6 +366,7 @@ func TestUpdateSecret(t *testing.T) {
 		"Update secret in grace period": {
 			expectedActions: []ktesting.Action{
 				ktesting.NewGetAction(nsSchema, "test-ns", "test-ns"),
+				ktesting.NewGetAction(saSchema, "test-ns", "test"),
 				ktesting.NewUpdateAction(secretSchema, "test-ns", istioTestSecret),
 			},
 			ttl:              time.Hour,
@@ -308,6 +376,7 @@ func TestUpdateSecret(t *testing.T) {
 		"Update secret in min grace period": {
 			expectedActions: []ktesting.Action{
 				ktesting.NewGetAction(nsSchema, "test-ns", "test-ns"),
+				ktesting.NewGetAction(saSchema, "test-ns", "test"),
 				ktesting.NewUpdateAction(secretSchema, "test-ns", istioTestSecret),
 			},
 			ttl:              10 * time.Minute,
@@ -317,6 +386,7 @@ func TestUpdateSecret(t *testing.T) {
 		"Update expired secret": {
 			expectedActions: []ktesting.Action{
 				ktesting.NewGetAction(nsSchema, "test-ns", "test-ns"),
+				ktesting.NewGetAction(saSchema, "test-ns", "test"),
 				ktesting.NewUpdateAction(secretSchema, "test-ns", istioTestSecret),
 			},
 			ttl:              -time.Second,
@@ -326,6 +396,7 @@ func TestUpdateSecret(t *testing.T) {
 		"Update secret with different root cert": {
 			expectedActions: []ktesting.Action{
 				ktesting.NewGetAction(nsSchema, "test-ns", "test-ns"),
+				ktesting.NewGetAction(saSchema, "test-ns", "test"),
 				ktesting.NewUpdateAction(secretSchema, "test-ns", istioTestSecret),
 			},
 			ttl:              time.Hour,
@@ -336,6 +407,7 @@ func TestUpdateSecret(t *testing.T) {
 		"Update secret with invalid certificate": {
 			expectedActions: []ktesting.Action{
 				ktesting.NewGetAction(nsSchema, "test-ns", "test-ns"),
+				ktesting.NewGetAction(saSchema, "test-ns", "test"),
 				ktesting.NewUpdateAction(secretSchema, "test-ns", istioTestSecret),
 			},
 			ttl:              time.Hour,
@@ -343,14 +415,53 @@ func TestUpdateSecret(t *testing.T) {
 			minGracePeriod:   10 * time.Minute,
 			certIsInvalid:    true,
 		},
+		"Update expired secret honors namespace TTL annotation": {
+			expectedActions: []ktesting.Action{
+				ktesting.NewGetAction(nsSchema, "test-ns", "test-ns"),
+				ktesting.NewGetAction(saSchema, "test-ns", "test"),
+				ktesting.NewUpdateAction(secretSchema, "test-ns", istioTestSecret),
+			},
+			ttl:              -time.Second,
+			gracePeriodRatio: 0.5,
+			minGracePeriod:   10 * time.Minute,
+			nsAnnotations:    map[string]string{CertPolicyTTLAnnotation: "24h"},
+		},
+		"Invalid SA annotation falls back to namespace value": {
+			expectedActions: []ktesting.Action{
+				ktesting.NewGetAction(nsSchema, "test-ns", "test-ns"),
+				ktesting.NewGetAction(saSchema, "test-ns", "test"),
+				ktesting.NewUpdateAction(secretSchema, "test-ns", istioTestSecret),
+			},
+			ttl:              -time.Second,
+			gracePeriodRatio: 0.5,
+			minGracePeriod:   10 * time.Minute,
+			nsAnnotations:    map[string]string{CertPolicyRSAKeySizeAnnotation: "2048"},
+			saAnnotations:    map[string]string{CertPolicyRSAKeySizeAnnotation: "not-a-number"},
+		},
 	}
 
 	for k, tc := range testCases {
 		client := fake.NewSimpleClientset()
 
-		controller, err := NewSecretController(createFakeCA(), enableNamespacesByDefault, time.Hour,
+		if len(tc.nsAnnotations) > 0 {
+			ns := createNS("test-ns", nil)
+			ns.Annotations = tc.nsAnnotations
+			if _, err := client.CoreV1().Namespaces().Create(ns); err != nil {
+				t.Error(err)
+			}
+		}
+		if len(tc.saAnnotations) > 0 {
+			sa := createServiceAccount("test", "test-ns")
+			sa.Annotations = tc.saAnnotations
+			if _, err := client.CoreV1().ServiceAccounts("test-ns").Create(sa); err != nil {
+				t.Error(err)
+			}
+		}
+
+		recordingCA := &recordingFakeCA{FakeCA: createFakeCA()}
+		controller, err := NewSecretController(recordingCA, enableNamespacesByDefault, time.Hour,
 			tc.gracePeriodRatio, tc.minGracePeriod, false, client.CoreV1(), false, false,
-			[]string{metav1.NamespaceAll}, nil, "")
+			[]string{metav1.NamespaceAll}, nil, "", NewTimeSource(), client.RbacV1(), false, nil)
 		if err != nil {
 			t.Errorf("failed to create secret controller: %v", err)
 		}
@@ -373,11 +484,24 @@ func TestUpdateSecret(t *testing.T) {
 			scrt.Data[CertChainID] = bs
 		}
 
+		client.ClearActions()
 		controller.scrtUpdated(nil, scrt)
 
-		if err := checkActions(client.Actions(), tc.expectedActions); err != nil {
+		actions := client.Actions()
+		if err := checkActions(actions, tc.expectedActions); err != nil {
 			t.Errorf("Case %q: %s", k, err.Error())
 		}
+
+		if nsTTL, ok := tc.nsAnnotations[CertPolicyTTLAnnotation]; ok {
+			wantTTL, err := time.ParseDuration(nsTTL)
+			if err != nil {
+				t.Fatalf("Case %q: bad test TTL annotation %q: %v", k, nsTTL, err)
+			}
+			if recordingCA.lastSignTTL != wantTTL {
+				t.Errorf("Case %q: expected ca.Sign to be called with ttl %v (from namespace annotation), got %v",
+					k, wantTTL, recordingCA.lastSignTTL)
+			}
+		}
 	}
 }
 
@@ -418,6 +542,28 @@ func TestManagedNamespaceRules(t *testing.T) {
 			enableNamespacesByDefault: true,
 			result:                    false,
 		},
+		"child namespace with a parent label still follows its own management rules": {
+			ns:                        createNS("child", map[string]string{NamespaceParentLabel: "parent"}),
+			istioCaStorageNamespace:   "test-ns",
+			enableNamespacesByDefault: false,
+			result:                    false,
+		},
+		"child namespace with a parent label and a matching managed label is still managed": {
+			ns:                        createNS("child", map[string]string{NamespaceParentLabel: "parent", NamespaceManagedLabel: "test-ns"}),
+			istioCaStorageNamespace:   "test-ns",
+			enableNamespacesByDefault: false,
+			result:                    true,
+		},
+		"cert-policy annotations do not affect management, only TTL/grace-period/key-size/SAN policy": {
+			ns: func() *v1.Namespace {
+				ns := createNS("unlabeled", map[string]string{NamespaceManagedLabel: "test-ns"})
+				ns.Annotations = map[string]string{CertPolicyTTLAnnotation: "24h", CertPolicyGracePeriodRatioAnnotation: "0.25"}
+				return ns
+			}(),
+			istioCaStorageNamespace:   "test-ns",
+			enableNamespacesByDefault: false,
+			result:                    true,
+		},
 	}
 
 	for k, tc := range testCases {
@@ -425,7 +571,7 @@ func TestManagedNamespaceRules(t *testing.T) {
 			client := fake.NewSimpleClientset()
 			controller, err := NewSecretController(createFakeCA(), tc.enableNamespacesByDefault, defaultTTL,
 				defaultGracePeriodRatio, defaultMinGracePeriod, false, client.CoreV1(), false, false,
-				[]string{metav1.NamespaceAll}, nil, tc.istioCaStorageNamespace)
+				[]string{metav1.NamespaceAll}, nil, tc.istioCaStorageNamespace, NewTimeSource(), client.RbacV1(), false, nil)
 			if err != nil {
 				t.Errorf("failed to create secret controller: %v", err)
 			}
@@ -464,6 +610,8 @@ func TestRetroactiveNamespaceActivation(t *testing.T) {
 		newNamespace              *v1.Namespace
 		secret                    *v1.Secret
 		sa                        *v1.ServiceAccount
+		childNamespace            *v1.Namespace
+		childSA                   *v1.ServiceAccount
 		expectedActions           []ktesting.Action
 	}{
 		"toggling label ca.istio.io/env from false->true generates service accounts": {
@@ -492,6 +640,24 @@ func TestRetroactiveNamespaceActivation(t *testing.T) {
 				ktesting.NewCreateAction(saSchema, "test", createServiceAccount("test-sa", "test")),
 			},
 		},
+		"activating a parent namespace also propagates to an already-managed child missing a secret": {
+			enableNamespacesByDefault: false,
+			istioCaStorageNamespace:   "citadel",
+			oldNamespace:              createNS("parent", map[string]string{NamespaceManagedLabel: ""}),
+			newNamespace:              createNS("parent", map[string]string{NamespaceManagedLabel: "citadel"}),
+			sa:                        createServiceAccount("parent-sa", "parent"),
+			childNamespace:            createNS("child", map[string]string{NamespaceParentLabel: "parent", NamespaceManagedLabel: "citadel"}),
+			childSA:                   createServiceAccount("child-sa", "child"),
+			expectedActions: []ktesting.Action{
+				ktesting.NewCreateAction(nsSchema, "", createNS("parent", map[string]string{})),
+				ktesting.NewCreateAction(saSchema, "parent", createServiceAccount("parent-sa", "parent")),
+				ktesting.NewListAction(saSchema, schema.GroupVersionKind{}, "parent", metav1.ListOptions{}),
+				ktesting.NewCreateAction(secretSchema, "parent", k8ssecret.BuildSecret("parent-sa", "istio.parent-sa", "parent", nil, nil, nil, nil, nil, IstioSecretType)),
+				ktesting.NewGetAction(nsSchema, "", "child"),
+				ktesting.NewListAction(saSchema, schema.GroupVersionKind{}, "child", metav1.ListOptions{}),
+				ktesting.NewCreateAction(secretSchema, "child", k8ssecret.BuildSecret("child-sa", "istio.child-sa", "child", nil, nil, nil, nil, nil, IstioSecretType)),
+			},
+		},
 	}
 
 	for k, tc := range testCases {
@@ -499,10 +665,22 @@ func TestRetroactiveNamespaceActivation(t *testing.T) {
 			client := fake.NewSimpleClientset()
 			controller, err := NewSecretController(createFakeCA(), tc.enableNamespacesByDefault, defaultTTL,
 				defaultGracePeriodRatio, defaultMinGracePeriod, false, client.CoreV1(), false, false,
-				[]string{metav1.NamespaceAll}, nil, tc.istioCaStorageNamespace)
+				[]string{metav1.NamespaceAll}, nil, tc.istioCaStorageNamespace, NewTimeSource(), client.RbacV1(), false, nil)
 			if err != nil {
 				t.Errorf("failed to create secret controller: %v", err)
 			}
+
+			if tc.childNamespace != nil {
+				if _, err := client.CoreV1().Namespaces().Create(tc.childNamespace); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := client.CoreV1().ServiceAccounts(tc.childNamespace.GetName()).Create(tc.childSA); err != nil {
+					t.Fatal(err)
+				}
+				// Populate the hierarchy index the way the namespace informer's AddFunc would.
+				controller.recordNamespaceParent(tc.childNamespace)
+			}
+
 			client.ClearActions()
 
 			if _, err := client.CoreV1().Namespaces().Create(tc.oldNamespace); err != nil {
@@ -517,6 +695,303 @@ func TestRetroactiveNamespaceActivation(t *testing.T) {
 			if err := checkActions(client.Actions(), tc.expectedActions); err != nil {
 				t.Errorf("Failure in test case %s: %v", k, err)
 			}
+
+			if tc.childSA != nil {
+				// The child had no secret of its own yet; propagation must create
+				// one rather than silently drop the inherited config via a failed Update.
+				if _, err := client.CoreV1().Secrets(tc.childNamespace.GetName()).Get(GetSecretName(tc.childSA.GetName()), metav1.GetOptions{}); err != nil {
+					t.Errorf("Case %q: expected a secret to be created for the child service account: %v", k, err)
+				}
+			}
+		})
+	}
+}
+
+func TestNamespaceHierarchyPropagation(t *testing.T) {
+	nsSchema := schema.GroupVersionResource{
+		Resource: "namespaces",
+		Version:  "v1",
+	}
+	saSchema := schema.GroupVersionResource{
+		Resource: "serviceaccounts",
+		Version:  "v1",
+	}
+	secretSchema := schema.GroupVersionResource{
+		Resource: "secrets",
+		Version:  "v1",
+	}
+
+	client := fake.NewSimpleClientset()
+	// Use enableNamespacesByDefault=false, as TestRetroactiveNamespaceActivation
+	// does, so parent's old->new transition below is a genuine unmanaged->managed
+	// edge rather than a no-op between two already-managed states.
+	controller, err := NewSecretController(createFakeCA(), false, defaultTTL,
+		defaultGracePeriodRatio, defaultMinGracePeriod, false, client.CoreV1(), false, false,
+		[]string{metav1.NamespaceAll}, nil, "citadel", NewTimeSource(), client.RbacV1(), false, nil)
+	if err != nil {
+		t.Fatalf("failed to create secret controller: %v", err)
+	}
+
+	oldParent := createNS("parent", map[string]string{})
+	newParent := createNS("parent", map[string]string{NamespaceManagedLabel: "citadel"})
+	child := createNS("child", map[string]string{NamespaceParentLabel: "parent", NamespaceManagedLabel: "citadel"})
+	childSA := createServiceAccount("child-sa", "child")
+
+	if _, err := client.CoreV1().Namespaces().Create(child); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.CoreV1().ServiceAccounts("child").Create(childSA); err != nil {
+		t.Fatal(err)
+	}
+	// Populate the hierarchy index the way the namespace informer's AddFunc would.
+	controller.recordNamespaceParent(child)
+
+	client.ClearActions()
+	controller.namespaceUpdated(oldParent, newParent)
+
+	expectedActions := []ktesting.Action{
+		ktesting.NewListAction(saSchema, schema.GroupVersionKind{}, "parent", metav1.ListOptions{}),
+		ktesting.NewGetAction(nsSchema, "", "child"),
+		ktesting.NewListAction(saSchema, schema.GroupVersionKind{}, "child", metav1.ListOptions{}),
+		ktesting.NewCreateAction(secretSchema, "child", k8ssecret.BuildSecret("child-sa", "istio.child-sa", "child", nil, nil, nil, nil, nil, IstioSecretType)),
+	}
+	if err := checkActions(client.Actions(), expectedActions); err != nil {
+		t.Errorf("%v", err)
+	}
+
+	// The child had no secret yet, so propagation must create one rather than
+	// attempt an Update that a fake/real apiserver would reject as NotFound.
+	created, err := client.CoreV1().Secrets("child").Get("istio.child-sa", metav1.GetOptions{})
+	if err != nil {
+		t.Fatalf("expected propagation to create a secret for the child service account: %v", err)
+	}
+	if created.Labels[NamespaceInheritedLabel] != "parent" {
+		t.Errorf("expected created secret to carry inherited-from label %q, got %q", "parent", created.Labels[NamespaceInheritedLabel])
+	}
+
+	// A cyclic parent declaration must be rejected rather than corrupting the index.
+	cyclic := createNS("parent", map[string]string{NamespaceParentLabel: "child"})
+	controller.recordNamespaceParent(cyclic)
+	controller.hierarchyMu.RLock()
+	_, stillCyclic := controller.parentByChild["parent"]
+	controller.hierarchyMu.RUnlock()
+	if stillCyclic {
+		t.Errorf("expected cyclic parent declaration to be rejected")
+	}
+}
+
+func TestProactiveRenewalScheduler(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	start := time.Now().UTC()
+	fakeTime := NewFakeTimeSource(start)
+
+	controller, err := NewSecretController(createFakeCA(), enableNamespacesByDefault, time.Hour,
+		defaultGracePeriodRatio, defaultMinGracePeriod, false, client.CoreV1(), false, false,
+		[]string{metav1.NamespaceAll}, nil, "", fakeTime, client.RbacV1(), false, nil)
+	if err != nil {
+		t.Fatalf("failed to create secret controller: %v", err)
+	}
+
+	scrt := k8ssecret.BuildSecret("test", "istio.test", "test-ns", certChain, caKey, rootCert, nil, nil, IstioSecretType)
+	bs, _, err := util.GenCertKeyFromOptions(util.CertOptions{
+		IsSelfSigned: true,
+		TTL:          time.Hour,
+		RSAKeySize:   512,
+	})
+	if err != nil {
+		t.Fatalf("failed to generate test certificate: %v", err)
+	}
+	scrt.Data[CertChainID] = bs
+
+	// Adding the secret should push a renewal heap entry; the grace period
+	// (30m, since 0.5*1h > the 10m floor) has not elapsed yet, so nothing
+	// should be due.
+	controller.scrtAdded(scrt)
+	if task := controller.popDueRenewal(); task != nil {
+		t.Fatalf("expected no renewal due immediately after scheduling, got %+v", task)
+	}
+
+	// Advancing past the grace period boundary should make the entry due.
+	fakeTime.Advance(31 * time.Minute)
+	task := controller.popDueRenewal()
+	if task == nil {
+		t.Fatalf("expected a renewal to be due after advancing past the grace period")
+	}
+	if task.namespace != "test-ns" || task.name != "istio.test" {
+		t.Errorf("unexpected renewal task %+v", task)
+	}
+
+	// The entry was popped, so nothing further should be pending.
+	if task := controller.popDueRenewal(); task != nil {
+		t.Errorf("expected the renewal heap to be drained, got %+v", task)
+	}
+}
+
+// TestGracePeriodOverrideAffectsRenewalSchedule verifies that a namespace's
+// grace-period-ratio override is honored when a secret is first scheduled.
+func TestGracePeriodOverrideAffectsRenewalSchedule(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	fakeTime := NewFakeTimeSource(time.Now().UTC())
+
+	ns := createNS("test-ns", nil)
+	ns.Annotations = map[string]string{CertPolicyGracePeriodRatioAnnotation: "1"} // always in grace period
+	if _, err := client.CoreV1().Namespaces().Create(ns); err != nil {
+		t.Fatal(err)
+	}
+
+	controller, err := NewSecretController(createFakeCA(), enableNamespacesByDefault, time.Hour,
+		0 /* controller-wide ratio: never proactively renews by default */, 0, false, client.CoreV1(), false, false,
+		[]string{metav1.NamespaceAll}, nil, "", fakeTime, client.RbacV1(), false, nil)
+	if err != nil {
+		t.Fatalf("failed to create secret controller: %v", err)
+	}
+
+	scrt := k8ssecret.BuildSecret("test", "istio.test", "test-ns", certChain, caKey, rootCert, nil, nil, IstioSecretType)
+	bs, _, err := util.GenCertKeyFromOptions(util.CertOptions{IsSelfSigned: true, TTL: time.Hour, RSAKeySize: 512})
+	if err != nil {
+		t.Fatalf("failed to generate test certificate: %v", err)
+	}
+	scrt.Data[CertChainID] = bs
+
+	controller.scrtAdded(scrt)
+
+	if task := controller.popDueRenewal(); task == nil {
+		t.Fatalf("expected the namespace's grace-period-ratio override to make the renewal due immediately")
+	}
+}
+
+// TestGracePeriodOverrideSurvivesResync verifies that scrtUpdated -- which
+// fires for every secret on each secretResyncPeriod tick, not just on a real
+// change -- preserves an override-based renewal schedule instead of
+// clobbering it back to the controller-wide default ratio.
+func TestGracePeriodOverrideSurvivesResync(t *testing.T) {
+	client := fake.NewSimpleClientset()
+	fakeTime := NewFakeTimeSource(time.Now().UTC())
+
+	ns := createNS("test-ns", nil)
+	ns.Annotations = map[string]string{CertPolicyGracePeriodRatioAnnotation: "1"} // always in grace period
+	if _, err := client.CoreV1().Namespaces().Create(ns); err != nil {
+		t.Fatal(err)
+	}
+
+	controller, err := NewSecretController(createFakeCA(), enableNamespacesByDefault, time.Hour,
+		0 /* controller-wide ratio: never proactively renews by default */, 0, false, client.CoreV1(), false, false,
+		[]string{metav1.NamespaceAll}, nil, "", fakeTime, client.RbacV1(), false, nil)
+	if err != nil {
+		t.Fatalf("failed to create secret controller: %v", err)
+	}
+
+	scrt := k8ssecret.BuildSecret("test", "istio.test", "test-ns", certChain, caKey, rootCert, nil, nil, IstioSecretType)
+	bs, _, err := util.GenCertKeyFromOptions(util.CertOptions{IsSelfSigned: true, TTL: time.Hour, RSAKeySize: 512})
+	if err != nil {
+		t.Fatalf("failed to generate test certificate: %v", err)
+	}
+	scrt.Data[CertChainID] = bs
+
+	controller.scrtAdded(scrt)
+
+	controller.renewalMu.Lock()
+	scheduledAt := controller.renewalTasks["test-ns/istio.test"].nextRenewal
+	controller.renewalMu.Unlock()
+
+	// Simulate the informer's periodic resync delivering an Update for a
+	// secret that hasn't actually changed.
+	controller.scrtUpdated(scrt, scrt)
+
+	controller.renewalMu.Lock()
+	got := controller.renewalTasks["test-ns/istio.test"].nextRenewal
+	controller.renewalMu.Unlock()
+
+	if !got.Equal(scheduledAt) {
+		t.Errorf("expected the grace-period-ratio override's schedule to survive a resync Update, got nextRenewal %v, want %v", got, scheduledAt)
+	}
+}
+
+func TestCertPolicyOverrides(t *testing.T) {
+	testCases := map[string]struct {
+		ns                   *v1.Namespace
+		sa                   *v1.ServiceAccount
+		wantNil              bool
+		wantTTL              time.Duration
+		wantGracePeriodRatio float32
+		wantRSAKeySize       int
+		wantExtraSANs        []string
+	}{
+		"no annotations anywhere yields no override": {
+			ns:      createNS("test-ns", nil),
+			sa:      createServiceAccount("test-sa", "test-ns"),
+			wantNil: true,
+		},
+		"namespace annotations are honored": {
+			ns: func() *v1.Namespace {
+				ns := createNS("test-ns", nil)
+				ns.Annotations = map[string]string{
+					CertPolicyTTLAnnotation:              "24h",
+					CertPolicyGracePeriodRatioAnnotation: "0.25",
+					CertPolicyRSAKeySizeAnnotation:       "4096",
+					CertPolicyExtraSANsAnnotation:        "extra1.example.com,extra2.example.com",
+				}
+				return ns
+			}(),
+			sa:                   createServiceAccount("test-sa", "test-ns"),
+			wantTTL:              24 * time.Hour,
+			wantGracePeriodRatio: 0.25,
+			wantRSAKeySize:       4096,
+			wantExtraSANs:        []string{"extra1.example.com", "extra2.example.com"},
+		},
+		"service account annotations take precedence over namespace": {
+			ns: func() *v1.Namespace {
+				ns := createNS("test-ns", nil)
+				ns.Annotations = map[string]string{CertPolicyTTLAnnotation: "24h", CertPolicyRSAKeySizeAnnotation: "4096"}
+				return ns
+			}(),
+			sa: func() *v1.ServiceAccount {
+				sa := createServiceAccount("test-sa", "test-ns")
+				sa.Annotations = map[string]string{CertPolicyTTLAnnotation: "1h"}
+				return sa
+			}(),
+			wantTTL:        time.Hour,
+			wantRSAKeySize: 4096,
+		},
+		"invalid values are ignored, falling back to the next most specific source": {
+			ns: func() *v1.Namespace {
+				ns := createNS("test-ns", nil)
+				ns.Annotations = map[string]string{CertPolicyGracePeriodRatioAnnotation: "2.5"}
+				return ns
+			}(),
+			sa: func() *v1.ServiceAccount {
+				sa := createServiceAccount("test-sa", "test-ns")
+				sa.Annotations = map[string]string{CertPolicyTTLAnnotation: "not-a-duration"}
+				return sa
+			}(),
+			wantNil: true,
+		},
+	}
+
+	for k, tc := range testCases {
+		t.Run(k, func(t *testing.T) {
+			overrides := computeCertPolicyOverrides(tc.ns, tc.sa)
+			if tc.wantNil {
+				if overrides != nil {
+					t.Fatalf("Case %q: expected no override, got %+v", k, overrides)
+				}
+				return
+			}
+			if overrides == nil {
+				t.Fatalf("Case %q: expected an override, got nil", k)
+			}
+			if tc.wantTTL != 0 && (overrides.ttl == nil || *overrides.ttl != tc.wantTTL) {
+				t.Errorf("Case %q: expected ttl %v, got %v", k, tc.wantTTL, overrides.ttl)
+			}
+			if tc.wantGracePeriodRatio != 0 && (overrides.gracePeriodRatio == nil || *overrides.gracePeriodRatio != tc.wantGracePeriodRatio) {
+				t.Errorf("Case %q: expected gracePeriodRatio %v, got %v", k, tc.wantGracePeriodRatio, overrides.gracePeriodRatio)
+			}
+			if tc.wantRSAKeySize != 0 && (overrides.rsaKeySize == nil || *overrides.rsaKeySize != tc.wantRSAKeySize) {
+				t.Errorf("Case %q: expected rsaKeySize %v, got %v", k, tc.wantRSAKeySize, overrides.rsaKeySize)
+			}
+			if tc.wantExtraSANs != nil && !reflect.DeepEqual(overrides.extraSANs, tc.wantExtraSANs) {
+				t.Errorf("Case %q: expected extraSANs %v, got %v", k, tc.wantExtraSANs, overrides.extraSANs)
+			}
 		})
 	}
 }
@@ -538,6 +1013,31 @@ func checkActions(actual, expected []ktesting.Action) error {
 	return nil
 }
 
+// FakeTimeSource is a TimeSource with explicit advance-time semantics, so
+// rotation timing can be asserted deterministically instead of via
+// wall-clock-dependent TTL tricks.
+type FakeTimeSource struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeTimeSource(now time.Time) *FakeTimeSource {
+	return &FakeTimeSource{now: now}
+}
+
+func (f *FakeTimeSource) UTCNow() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Advance moves the fake clock forward by d.
+func (f *FakeTimeSource) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
+
 func createFakeCA() *mockca.FakeCA {
 	return &mockca.FakeCA{
 		SignedCert: signedCert,
@@ -551,6 +1051,21 @@ func createFakeCA() *mockca.FakeCA {
 	}
 }
 
+// recordingFakeCA wraps FakeCA to capture the ttl passed into Sign. FakeCA's
+// signed output is a fixed literal regardless of ttl, so it cannot be used to
+// verify TTL-honoring behavior by parsing the issued certificate back out;
+// tests that care about the requested TTL should assert on lastSignTTL
+// instead.
+type recordingFakeCA struct {
+	*mockca.FakeCA
+	lastSignTTL time.Duration
+}
+
+func (ca *recordingFakeCA) Sign(csrPEM []byte, ttl time.Duration, forCA bool) ([]byte, error) {
+	ca.lastSignTTL = ttl
+	return ca.FakeCA.Sign(csrPEM, ttl, forCA)
+}
+
 func createServiceAccount(name, namespace string) *v1.ServiceAccount {
 	return &v1.ServiceAccount{
 		ObjectMeta: metav1.ObjectMeta{